@@ -0,0 +1,35 @@
+package nonce
+
+import (
+	"sync"
+	"time"
+)
+
+// fakeClock is a Clock whose Now can be advanced manually, letting tests
+// observe expiry without sleeping past it.
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Unix(0, 0)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// After never fires on its own; tests that only need deterministic expiry
+// checks (not the background sweeper) can ignore the returned channel.
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	return make(chan time.Time)
+}
@@ -0,0 +1,106 @@
+// Package http turns a nonce.Store into a drop-in CSRF layer for net/http
+// servers: Middleware auto-issues a nonce on safe requests and requires one
+// on unsafe requests, and FuncMap lets HTML templates embed it as a hidden
+// form field.
+package http
+
+import (
+	"html/template"
+	nethttp "net/http"
+
+	"github.com/apokalyptik/nonce"
+)
+
+// DefaultHeader is the header Middleware, IssueHeader, and RequireHeader
+// read and write when no WithHeader option is given, following the
+// convention used by request-signing middlewares such as Authy.
+const DefaultHeader = "X-Nonce"
+
+// Option configures Middleware.
+type Option func(*config)
+
+type config struct {
+	header string
+	action func(r *nethttp.Request) string
+}
+
+// WithHeader overrides the header Middleware reads and writes.
+func WithHeader(name string) Option {
+	return func(c *config) { c.header = name }
+}
+
+// WithAction overrides how Middleware derives a nonce's action string from
+// the request it's issued for or verified against.  The default is just the
+// URL path, so a nonce issued for a GET is still valid for the POST to the
+// same path.
+func WithAction(f func(r *nethttp.Request) string) Option {
+	return func(c *config) { c.action = f }
+}
+
+func defaultAction(r *nethttp.Request) string {
+	return r.URL.Path
+}
+
+// Middleware returns net/http middleware that issues a nonce from store on
+// safe requests (GET, HEAD) and requires and verifies one on every other
+// method (POST, PUT, DELETE, PATCH, and also e.g. OPTIONS), both via a
+// configurable header.  Verification failure responds 403 Forbidden without
+// calling the wrapped handler.
+func Middleware(store nonce.Store, opts ...Option) func(nethttp.Handler) nethttp.Handler {
+	c := &config{header: DefaultHeader, action: defaultAction}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return func(next nethttp.Handler) nethttp.Handler {
+		return nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+			action := c.action(r)
+			switch r.Method {
+			case nethttp.MethodGet, nethttp.MethodHead:
+				w.Header().Set(c.header, store.Nonce(action))
+			default:
+				if !store.Verify(r.Header.Get(c.header), action) {
+					nethttp.Error(w, "invalid or missing nonce", nethttp.StatusForbidden)
+					return
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// IssueHeader issues a nonce for action from store and writes it to w using
+// the given header, returning the nonce for convenience (e.g. to also embed
+// it in a response body).
+func IssueHeader(w nethttp.ResponseWriter, store nonce.Store, header, action string) string {
+	n := store.Nonce(action)
+	w.Header().Set(header, n)
+	return n
+}
+
+// RequireHeader returns middleware that verifies a nonce for action, read
+// from the given header, on every request it wraps regardless of method,
+// responding 403 Forbidden on failure.
+func RequireHeader(store nonce.Store, header, action string) func(nethttp.Handler) nethttp.Handler {
+	return func(next nethttp.Handler) nethttp.Handler {
+		return nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+			if !store.Verify(r.Header.Get(header), action) {
+				nethttp.Error(w, "invalid or missing nonce", nethttp.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// FuncMap returns a template.FuncMap with a single "nonce" function that
+// issues a nonce for the given action, for embedding as a hidden form
+// field:
+//
+//    <input type="hidden" name="nonce" value="{{nonce "123:foo:delete"}}">
+func FuncMap(store nonce.Store) template.FuncMap {
+	return template.FuncMap{
+		"nonce": func(action string) string {
+			return store.Nonce(action)
+		},
+	}
+}
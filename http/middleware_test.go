@@ -0,0 +1,70 @@
+package http
+
+import (
+	nethttp "net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/apokalyptik/nonce"
+)
+
+func TestMiddleware(t *testing.T) {
+	store, err := nonce.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	next := nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		w.WriteHeader(nethttp.StatusOK)
+	})
+	handler := Middleware(store)(next)
+
+	get := httptest.NewRequest(nethttp.MethodGet, "/widgets/foo", nil)
+	getResp := httptest.NewRecorder()
+	handler.ServeHTTP(getResp, get)
+	if getResp.Code != nethttp.StatusOK {
+		t.Fatalf("Expected GET to succeed, got %d", getResp.Code)
+	}
+	n := getResp.Header().Get(DefaultHeader)
+	if n == "" {
+		t.Fatal("Expected GET to issue a nonce header")
+	}
+
+	post := httptest.NewRequest(nethttp.MethodPost, "/widgets/foo", nil)
+	post.Header.Set(DefaultHeader, n)
+	postResp := httptest.NewRecorder()
+	handler.ServeHTTP(postResp, post)
+	if postResp.Code != nethttp.StatusOK {
+		t.Fatalf("Expected POST with valid nonce to succeed, got %d", postResp.Code)
+	}
+
+	replay := httptest.NewRequest(nethttp.MethodPost, "/widgets/foo", nil)
+	replay.Header.Set(DefaultHeader, n)
+	replayResp := httptest.NewRecorder()
+	handler.ServeHTTP(replayResp, replay)
+	if replayResp.Code != nethttp.StatusForbidden {
+		t.Fatalf("Expected replayed nonce to be rejected, got %d", replayResp.Code)
+	}
+
+	noNonce := httptest.NewRequest(nethttp.MethodPost, "/widgets/foo", nil)
+	noNonceResp := httptest.NewRecorder()
+	handler.ServeHTTP(noNonceResp, noNonce)
+	if noNonceResp.Code != nethttp.StatusForbidden {
+		t.Fatalf("Expected POST without nonce to be rejected, got %d", noNonceResp.Code)
+	}
+}
+
+func TestFuncMap(t *testing.T) {
+	store, err := nonce.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	funcs := FuncMap(store)
+	nonceFunc, ok := funcs["nonce"].(func(string) string)
+	if !ok {
+		t.Fatal("Expected FuncMap to contain a \"nonce\" function")
+	}
+	n := nonceFunc("123:foo:delete")
+	if !store.Verify(n, "123:foo:delete") {
+		t.Errorf("Expected nonce from FuncMap to verify against its action")
+	}
+}
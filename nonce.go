@@ -1,5 +1,5 @@
-// nonce provides you with a small set of tools for working with an in-memory
-// nonce store.  Typically you would create a nonce in your application to help
+// nonce provides you with a small set of tools for working with a nonce
+// store.  Typically you would create a nonce in your application to help
 // validate the authenticity of requested actions as well as prevent certain
 // kinds of attacks, such as reply attacks.
 //
@@ -21,11 +21,23 @@
 //        //     figure our how your app works.  Sometimes the worst case is
 //        //     just paranoia :)
 //    }
+//
+// New returns the default in-memory, single-process store.  If you need
+// nonces to survive a restart or to be verified by any instance behind a
+// load balancer, construct a MemoryStore-compatible Store backed by
+// NewRedisStore or NewSQLStore instead (with the same Salt set on every
+// instance), or use NewStateless with the same key on every instance for a
+// store that needs no shared server-side state.
 package nonce
 
 import (
+	"crypto/hmac"
 	"crypto/rand"
 	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"hash"
 	"io"
@@ -33,15 +45,185 @@ import (
 	"time"
 )
 
-// Store provides a non-persisted in-memory store for, as well as functions to
-// create and verify, nonces.
-type Store struct {
+// statelessRandomLen is the number of random bytes embedded in a stateless
+// nonce alongside its expiry, to keep two nonces issued for the same action
+// in the same nanosecond from colliding.
+const statelessRandomLen = 16
+
+// Store is implemented by every nonce storage engine in this package:
+// MemoryStore (the default, returned by New and NewStateless), RedisStore,
+// and SQLStore.  Code that only needs to issue and verify nonces should
+// depend on Store rather than a concrete type, so the backend can be swapped
+// without touching callers.
+type Store interface {
+	// Nonce creates a nonce for the provided action.
+	Nonce(action string) string
+	// Verify validates a nonce against an action, consuming it so it can't
+	// be verified a second time.
+	Verify(nonce, action string) bool
+	// Peek reports whether a valid matching nonce exists without consuming
+	// it.
+	Peek(nonce, action string) bool
+	// Timeout sets how long newly issued nonces remain valid for.
+	Timeout(t time.Duration) Store
+	// Salt sets the salt mixed into newly issued nonces.
+	Salt(salt string) Store
+}
+
+// Clock abstracts time so a Store's expiry checks and background sweeper
+// can be driven by something other than the real wall clock in tests.  It
+// mirrors the interface of github.com/jmhodges/clock.Clock.  Stores created
+// by New and NewStateless use realClock, which just delegates to the time
+// package, unless WithClock is given.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                        { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// Option configures a store created by New or NewStateless.
+type Option func(*MemoryStore)
+
+// WithClock overrides the Clock a store uses instead of the real wall
+// clock.  This lets tests advance a fake clock to observe expiry rather
+// than sleeping past it.
+func WithClock(c Clock) Option {
+	return func(s *MemoryStore) { s.clock = c }
+}
+
+// Verify result strings, reported to both Observer.OnVerify and whichever
+// Metrics counter matches.
+const (
+	VerifyResultHit      = "hit"
+	VerifyResultMiss     = "miss"
+	VerifyResultExpired  = "expired"
+	VerifyResultMismatch = "mismatch"
+)
+
+// Counter is the subset of prometheus.Counter (and prometheus.CounterVec's
+// WithLabelValues) that Store needs.
+type Counter interface {
+	Inc()
+}
+
+// Gauge is the subset of prometheus.Gauge that Store needs.
+type Gauge interface {
+	Set(float64)
+}
+
+// Histogram is the subset of prometheus.Histogram that Store needs.
+type Histogram interface {
+	Observe(float64)
+}
+
+// Metrics is the set of instruments WithMetrics wires into a store.  A nil
+// field skips that instrument.  Because each field's type is the narrow
+// interface Store actually calls, they can be backed directly by
+// instruments from github.com/prometheus/client_golang/prometheus -- for
+// example VerifyHit would be nonceVerifiedTotal.WithLabelValues("hit").
+type Metrics struct {
+	Issued         Counter
+	VerifyHit      Counter
+	VerifyMiss     Counter
+	VerifyExpired  Counter
+	VerifyMismatch Counter
+	Active         Gauge
+	GCDuration     Histogram
+}
+
+// WithMetrics wires m into the store: Nonce increments m.Issued, Verify
+// increments whichever of m.VerifyHit/Miss/Expired/Mismatch matches its
+// outcome, and the expiry sweep reports m.Active and observes
+// m.GCDuration.
+func WithMetrics(m Metrics) Option {
+	return func(s *MemoryStore) { s.metrics = m }
+}
+
+// Observer receives nonce lifecycle events as they happen, for structured
+// audit logging or alerting on an unusual rate of verify mismatches --
+// which may indicate the "user poking their nose around your API" case the
+// package comment above jokes about.
+type Observer interface {
+	// OnIssue is invoked after Nonce or NonceWithOptions issues a nonce.
+	OnIssue(action string)
+	// OnVerify is invoked after Verify, with one of the VerifyResult*
+	// constants.
+	OnVerify(result string)
+	// OnExpireSweep is invoked after every Sweep, whether run by the
+	// background sweeper or called directly, with the number of nonces it
+	// removed.
+	OnExpireSweep(removed int)
+}
+
+// WithObserver registers o to receive nonce lifecycle events from the
+// store.
+func WithObserver(o Observer) Option {
+	return func(s *MemoryStore) { s.observer = o }
+}
+
+// WithSweepInterval overrides how often the background sweeper checks for
+// expired nonces.  The default, used when this is left unset, is half the
+// store's expiration.
+func WithSweepInterval(d time.Duration) Option {
+	return func(s *MemoryStore) { s.sweepInterval = d }
+}
+
+// nonceRecord is what MemoryStore actually keeps per outstanding nonce.
+// remainingUses reaches zero exactly once Verify has consumed the last use
+// a nonce was issued with, at which point it is deleted from nonces.
+type nonceRecord struct {
+	expires       time.Time
+	remainingUses int
+	purpose       string
+}
+
+// MemoryStore is the default, non-persisted, single-process Store
+// implementation: nonces live in an in-memory map and do not survive a
+// restart or scale-out to a second instance.
+type MemoryStore struct {
 	m             sync.RWMutex
 	salt          string
 	expiration    time.Duration
-	nonces        map[string]time.Time
+	nonces        map[string]nonceRecord
 	h             hash.Hash
 	newExpiration chan struct{}
+	key           []byte
+	consumed      map[string]int64
+	clock         Clock
+	metrics       Metrics
+	observer      Observer
+	sweepInterval time.Duration
+}
+
+// NonceOption configures a single nonce issued by NonceWithOptions.
+type NonceOption func(*nonceOptions)
+
+type nonceOptions struct {
+	ttl     time.Duration
+	uses    int
+	purpose string
+}
+
+// WithTTL overrides the store's default expiration for a single nonce.
+func WithTTL(d time.Duration) NonceOption {
+	return func(o *nonceOptions) { o.ttl = d }
+}
+
+// WithUses sets how many times a single nonce can be verified before it is
+// removed from the store.  Nonce issues nonces with a single use; Peek
+// never counts against this.
+func WithUses(n int) NonceOption {
+	return func(o *nonceOptions) { o.uses = n }
+}
+
+// WithPurpose tags a nonce with a caller-defined class, e.g.
+// "password-reset", so it can later be found with FindByPurpose.
+func WithPurpose(purpose string) NonceOption {
+	return func(o *nonceOptions) { o.purpose = purpose }
 }
 
 // Timeout allows you to specify how long nonces are valid for.  This function
@@ -49,8 +231,11 @@ type Store struct {
 // it.  Updating this value has the side effect of updating how often the go
 // map (which actually holds all of the nonces internally) is scanned for
 // expired nonces.
-func (s *Store) Timeout(t time.Duration) *Store {
+// An interval set with WithSweepInterval is not affected.
+func (s *MemoryStore) Timeout(t time.Duration) Store {
+	s.m.Lock()
 	s.expiration = t
+	s.m.Unlock()
 	s.newExpiration <- struct{}{}
 	return s
 }
@@ -59,80 +244,221 @@ func (s *Store) Timeout(t time.Duration) *Store {
 // This should only be done after creating the store but before using it as
 // changing this value will immediately invalidate all existing nonces
 // regardless of their existence or expiration
-func (s *Store) Salt(salt string) *Store {
+func (s *MemoryStore) Salt(salt string) Store {
+	s.m.Lock()
 	s.salt = salt
+	s.m.Unlock()
 	return s
 }
 
 // Nonce creates a nonce for the provided action.  Given the resulting string
 // and the original action string you can use *store.Verify() and *store.Peek()
 // at a later time to validate the nonce.
-func (s *Store) Nonce(action string) string {
+func (s *MemoryStore) Nonce(action string) string {
+	return s.NonceWithOptions(action)
+}
+
+// NonceWithOptions creates a nonce for the provided action, as Nonce does,
+// but lets you override its TTL, how many times it can be verified before
+// it's removed from the store, and tag it with a purpose for later lookup
+// via FindByPurpose.
+func (s *MemoryStore) NonceWithOptions(action string, opts ...NonceOption) string {
+	if s.h == nil {
+		// A store created by NewStateless has no hash.Hash of its own --
+		// use NonceStateless instead.
+		return ""
+	}
 	s.m.Lock()
 	defer s.m.Unlock()
-	t := time.Now().Add(s.expiration)
-	h := s.hash(action, t)
-	s.nonces[h] = t
+	o := nonceOptions{ttl: s.expiration, uses: 1}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	t := s.clock.Now().Add(o.ttl)
+	h := computeHash(s.h, action, s.salt, t)
+	s.nonces[h] = nonceRecord{expires: t, remainingUses: o.uses, purpose: o.purpose}
+	if s.metrics.Issued != nil {
+		s.metrics.Issued.Inc()
+	}
+	if s.observer != nil {
+		s.observer.OnIssue(action)
+	}
+	if s.metrics.Active != nil {
+		s.metrics.Active.Set(float64(len(s.nonces)))
+	}
 	return h
 }
 
 // Verify validates a nonce against an action.  It checkes that all of the
 // following are true: the nonce exists, the nonce has not expired, the nonce
-// is for the action provided.
-func (s *Store) Verify(nonce, action string) bool {
-	s.m.RLock()
-	defer s.m.RUnlock()
-	if t, ok := s.nonces[nonce]; ok {
-		if time.Now().After(t) {
-			return false
-		}
-		if s.hash(action, t) == nonce {
-			delete(s.nonces, nonce)
-			return true
+// is for the action provided.  A nonce is removed from the store only once
+// its remaining uses (1, unless NonceWithOptions was given WithUses) are
+// exhausted.
+func (s *MemoryStore) Verify(nonce, action string) bool {
+	if s.h == nil {
+		// A store created by NewStateless keeps no map of issued nonces --
+		// use VerifyStateless instead.
+		return false
+	}
+	s.m.Lock()
+	defer s.m.Unlock()
+	result := VerifyResultMiss
+	success := false
+	if r, ok := s.nonces[nonce]; ok {
+		switch {
+		case s.clock.Now().After(r.expires):
+			result = VerifyResultExpired
+		case computeHash(s.h, action, s.salt, r.expires) != nonce:
+			result = VerifyResultMismatch
+		default:
+			result = VerifyResultHit
+			success = true
+			r.remainingUses--
+			if r.remainingUses <= 0 {
+				delete(s.nonces, nonce)
+			} else {
+				s.nonces[nonce] = r
+			}
 		}
 	}
-	return false
+	s.reportVerify(result)
+	if success && s.metrics.Active != nil {
+		s.metrics.Active.Set(float64(len(s.nonces)))
+	}
+	return success
+}
+
+// reportVerify notifies the observer and increments the Metrics counter
+// matching result.
+func (s *MemoryStore) reportVerify(result string) {
+	if s.observer != nil {
+		s.observer.OnVerify(result)
+	}
+	var c Counter
+	switch result {
+	case VerifyResultHit:
+		c = s.metrics.VerifyHit
+	case VerifyResultExpired:
+		c = s.metrics.VerifyExpired
+	case VerifyResultMismatch:
+		c = s.metrics.VerifyMismatch
+	default:
+		c = s.metrics.VerifyMiss
+	}
+	if c != nil {
+		c.Inc()
+	}
 }
 
 // Peek allows you to see if a valid matching nonce exists without actually
 // removing it from the store.
-func (s *Store) Peek(nonce, action string) bool {
-	s.m.RLock()
-	defer s.m.RUnlock()
-	if t, ok := s.nonces[nonce]; ok {
-		if time.Now().After(t) {
+func (s *MemoryStore) Peek(nonce, action string) bool {
+	if s.h == nil {
+		// A store created by NewStateless keeps no map of issued nonces to
+		// peek at.
+		return false
+	}
+	// computeHash resets and writes through the store's single shared
+	// hash.Hash, so -- like Verify and NonceWithOptions -- this needs the
+	// full Lock rather than RLock even though Peek itself only reads.
+	s.m.Lock()
+	defer s.m.Unlock()
+	if r, ok := s.nonces[nonce]; ok {
+		if s.clock.Now().After(r.expires) {
 			return false
 		}
-		if s.hash(action, t) == nonce {
+		if computeHash(s.h, action, s.salt, r.expires) == nonce {
 			return true
 		}
 	}
 	return false
 }
 
-func (s *Store) hash(action string, t time.Time) string {
-	s.h.Reset()
-	io.WriteString(s.h, fmt.Sprintf("%s:%s:%s", t.String(), action, s.salt))
-	var theHash = s.h.Sum(nil)
-	var rval = make([]byte, len(theHash))
-	for k, v := range theHash {
-		rval[k] = v
+// FindByPurpose returns the nonces currently outstanding that were issued
+// with WithPurpose(purpose), e.g. for an admin or audit endpoint that needs
+// to enumerate outstanding password-reset nonces without exposing the
+// whole store.
+func (s *MemoryStore) FindByPurpose(purpose string) []string {
+	s.m.RLock()
+	defer s.m.RUnlock()
+	var rval []string
+	for k, r := range s.nonces {
+		if r.purpose == purpose {
+			rval = append(rval, k)
+		}
 	}
+	return rval
+}
+
+// computeHash derives the nonce for action, salt, and t using h.  h is
+// reset before use, so it must not be shared across concurrent callers
+// without a lock -- every Store implementation in this package guards its
+// hash.Hash with its own mutex.
+func computeHash(h hash.Hash, action, salt string, t time.Time) string {
+	h.Reset()
+	// Strip the monotonic reading so the hash matches even when t has been
+	// round-tripped through a backend that only stores the wall clock
+	// value, e.g. RedisStore serializing it to UnixNano.
+	t = t.Round(0)
+	io.WriteString(h, fmt.Sprintf("%s:%s:%s", t.String(), action, salt))
+	var theHash = h.Sum(nil)
+	var rval = make([]byte, len(theHash))
+	copy(rval, theHash)
 	return string(rval)
 }
 
-func (s *Store) mindExpiration() {
+// Sweep removes every nonce whose expiry has passed, reporting to the
+// Metrics and Observer wired in by WithMetrics/WithObserver the same way
+// the background sweeper does, and returns how many were removed.  It is
+// exported so tests, and callers who want precise control over when GC
+// happens, can drive it directly instead of waiting for the next
+// sweepInterval tick.
+func (s *MemoryStore) Sweep() int {
+	start := time.Now()
+	now := s.clock.Now()
+	s.m.Lock()
+	removed := 0
+	for k, v := range s.nonces {
+		if now.After(v.expires) {
+			delete(s.nonces, k)
+			removed++
+		}
+	}
+	active := len(s.nonces)
+	s.m.Unlock()
+	if s.observer != nil {
+		s.observer.OnExpireSweep(removed)
+	}
+	if s.metrics.GCDuration != nil {
+		s.metrics.GCDuration.Observe(time.Since(start).Seconds())
+	}
+	if s.metrics.Active != nil {
+		s.metrics.Active.Set(float64(active))
+	}
+	return removed
+}
+
+// sweepIntervalOrDefault returns how often the background sweeper runs:
+// the value set by WithSweepInterval, or half the store's expiration if
+// unset.
+func (s *MemoryStore) sweepIntervalOrDefault() time.Duration {
+	s.m.RLock()
+	defer s.m.RUnlock()
+	if s.sweepInterval > 0 {
+		return s.sweepInterval
+	}
+	return s.expiration / 2
+}
+
+// mindExpiration runs the background sweeper: every sweepIntervalOrDefault
+// it calls Sweep, and it wakes early whenever Timeout signals via
+// newExpiration so a shortened expiration takes effect without waiting out
+// the old interval.
+func (s *MemoryStore) mindExpiration() {
 	for {
-		c := <-time.After(5 * s.expiration)
 		select {
-		case when := <-c:
-			s.m.Lock()
-			for k, v := range s.nonces {
-				if when.After(v) {
-					delete(s.nonces, k)
-				}
-			}
-			s.m.Unlock()
+		case <-s.clock.After(s.sweepIntervalOrDefault()):
+			s.Sweep()
 		case <-s.newExpiration:
 			continue
 		}
@@ -140,19 +466,131 @@ func (s *Store) mindExpiration() {
 }
 
 // New returns a new nonce store.  You should always use this function instead
-// of var something = &nonce.Store{} because it sets defaults, and begins the
-// goroutine responsible for cleaning up expired nonces from the store.
-func New() (*Store, error) {
+// of var something = &nonce.MemoryStore{} because it sets defaults, and begins
+// the goroutine responsible for cleaning up expired nonces from the store.
+func New(opts ...Option) (*MemoryStore, error) {
 	var randBytes = make([]byte, 20)
 	if _, e := rand.Read(randBytes); e != nil {
 		return nil, e
 	}
-	var rval = &Store{
-		expiration: time.Duration(30 * time.Minute),
-		nonces:     map[string]time.Time{},
-		salt:       string(randBytes),
-		h:          sha1.New(),
+	var rval = &MemoryStore{
+		expiration:    time.Duration(30 * time.Minute),
+		nonces:        map[string]nonceRecord{},
+		salt:          string(randBytes),
+		h:             sha1.New(),
+		clock:         realClock{},
+		newExpiration: make(chan struct{}, 1),
+	}
+	for _, opt := range opts {
+		opt(rval)
 	}
 	go rval.mindExpiration()
 	return rval, nil
 }
+
+// NewStateless returns a nonce store which issues self-contained, signed
+// nonces instead of keeping them in an in-memory map.  The expiry is encoded
+// directly into the nonce and its authenticity is guaranteed by an
+// HMAC-SHA256 signature over the expiry, a random value, and the action, so
+// any process holding the same key can verify a nonce issued by another --
+// no shared state required.  This is useful for services running behind a
+// load balancer where a *MemoryStore created with New() can't be shared
+// across instances.
+//
+// Because there is no shared map to delete an entry from, one-shot
+// semantics are approximated by remembering verified nonces in a small
+// in-memory set guarded by the same mutex as the stateful store; this means
+// NewStateless still only protects against replay on the instance which
+// verified the nonce first.
+//
+// The returned store has no hash.Hash of its own, so Nonce, Verify, and
+// Peek -- which only make sense against the in-memory map New's store
+// keeps -- are no-ops returning their zero value; use NonceStateless and
+// VerifyStateless instead.
+func NewStateless(key []byte, opts ...Option) (*MemoryStore, error) {
+	if len(key) == 0 {
+		return nil, errors.New("nonce: NewStateless requires a non-empty key")
+	}
+	var rval = &MemoryStore{
+		expiration:    time.Duration(30 * time.Minute),
+		nonces:        map[string]nonceRecord{},
+		key:           key,
+		consumed:      map[string]int64{},
+		clock:         realClock{},
+		newExpiration: make(chan struct{}, 1),
+	}
+	for _, opt := range opts {
+		opt(rval)
+	}
+	go rval.mindExpiration()
+	return rval, nil
+}
+
+// NonceStateless creates a signed, self-contained nonce for the provided
+// action.  Unlike Nonce, the returned string is not recorded anywhere --
+// everything the store needs to verify it later is encoded in the nonce
+// itself.
+func (s *MemoryStore) NonceStateless(action string) (string, error) {
+	if len(s.key) == 0 {
+		return "", errors.New("nonce: store was not created with NewStateless")
+	}
+	var random = make([]byte, statelessRandomLen)
+	if _, e := rand.Read(random); e != nil {
+		return "", e
+	}
+	s.m.RLock()
+	expiration := s.expiration
+	s.m.RUnlock()
+	expires := s.clock.Now().Add(expiration).UnixNano()
+	return s.signStateless(expires, random, action), nil
+}
+
+// VerifyStateless validates a nonce produced by NonceStateless against an
+// action.  It checks that the embedded expiry has not passed and that the
+// HMAC signature matches before consuming the nonce so it cannot be
+// replayed.
+func (s *MemoryStore) VerifyStateless(nonce, action string) bool {
+	if len(s.key) == 0 {
+		return false
+	}
+	raw, e := base64.URLEncoding.DecodeString(nonce)
+	if e != nil || len(raw) != 8+statelessRandomLen+sha256.Size {
+		return false
+	}
+	expires := int64(binary.BigEndian.Uint64(raw[:8]))
+	now := s.clock.Now().UnixNano()
+	if now >= expires {
+		return false
+	}
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write(raw[:8+statelessRandomLen])
+	io.WriteString(mac, action)
+	if !hmac.Equal(mac.Sum(nil), raw[8+statelessRandomLen:]) {
+		return false
+	}
+	s.m.Lock()
+	defer s.m.Unlock()
+	if _, used := s.consumed[nonce]; used {
+		return false
+	}
+	s.consumed[nonce] = expires
+	for k, exp := range s.consumed {
+		if exp < now {
+			delete(s.consumed, k)
+		}
+	}
+	return true
+}
+
+// signStateless encodes expires and random into a payload, signs it with
+// an HMAC-SHA256 keyed by s.key, and returns the base64 encoding of
+// payload||signature.
+func (s *MemoryStore) signStateless(expires int64, random []byte, action string) string {
+	var payload = make([]byte, 8+len(random))
+	binary.BigEndian.PutUint64(payload[:8], uint64(expires))
+	copy(payload[8:], random)
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write(payload)
+	io.WriteString(mac, action)
+	return base64.URLEncoding.EncodeToString(append(payload, mac.Sum(nil)...))
+}
@@ -2,12 +2,15 @@ package nonce
 
 import (
 	"log"
+	"sync"
 	"testing"
 	"time"
 )
 
 func TestBasicUsage(t *testing.T) {
-	store, err := New()
+	// A long sweep interval keeps the background sweeper from racing the
+	// manual Sweep() call below against this test's own timing assumptions.
+	store, err := New(WithSweepInterval(time.Hour))
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -42,7 +45,7 @@ func TestBasicUsage(t *testing.T) {
 	if _, ok := store.nonces[n]; !ok {
 		t.Errorf("Expected expired but non-cleaned up nonce to still exist")
 	}
-	time.Sleep(time.Duration(126 * time.Millisecond))
+	store.Sweep()
 	if _, ok := store.nonces[n]; ok {
 		t.Errorf("Expected expired nonce to have been cleaned up")
 	}
@@ -51,3 +54,236 @@ func TestBasicUsage(t *testing.T) {
 		log.Printf("Expected two stores to contain unique, random, salts")
 	}
 }
+
+func TestBasicUsageWithFakeClock(t *testing.T) {
+	clock := newFakeClock()
+	store, err := New(WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Timeout(time.Duration(25 * time.Millisecond))
+	n := store.Nonce("test")
+	if !store.Peek(n, "test") {
+		t.Errorf("Expected Peek on valid key to return true")
+	}
+	clock.Advance(26 * time.Millisecond)
+	if store.Verify(n, "test") {
+		t.Errorf("Expected Verify on expired key to return false")
+	}
+}
+
+func TestNonceWithOptions(t *testing.T) {
+	store, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Timeout(time.Duration(30 * time.Minute))
+
+	n := store.NonceWithOptions("test", WithTTL(25*time.Millisecond), WithUses(2), WithPurpose("password-reset"))
+	if !store.Verify(n, "test") {
+		t.Errorf("Expected first Verify on a two-use nonce to return true")
+	}
+	if !store.Verify(n, "test") {
+		t.Errorf("Expected second Verify on a two-use nonce to return true")
+	}
+	if store.Verify(n, "test") {
+		t.Errorf("Expected third Verify on a two-use nonce to return false")
+	}
+
+	n = store.NonceWithOptions("test", WithPurpose("password-reset"))
+	found := store.FindByPurpose("password-reset")
+	if len(found) != 1 || found[0] != n {
+		t.Errorf("Expected FindByPurpose to return the outstanding password-reset nonce, got %v", found)
+	}
+	if len(store.FindByPurpose("no-such-purpose")) != 0 {
+		t.Errorf("Expected FindByPurpose for an unused purpose to return no nonces")
+	}
+}
+
+// fakeCounter, fakeGauge, and fakeObserver are minimal stand-ins for
+// prometheus instruments and an audit logger, just enough to exercise
+// WithMetrics and WithObserver without any external dependency.
+type fakeCounter struct{ count int }
+
+func (c *fakeCounter) Inc() { c.count++ }
+
+type fakeGauge struct{ value float64 }
+
+func (g *fakeGauge) Set(v float64) { g.value = v }
+
+type fakeObserver struct {
+	issued  []string
+	results []string
+}
+
+func (o *fakeObserver) OnIssue(action string)  { o.issued = append(o.issued, action) }
+func (o *fakeObserver) OnVerify(result string) { o.results = append(o.results, result) }
+func (o *fakeObserver) OnExpireSweep(int)      {}
+
+func TestMetricsAndObserver(t *testing.T) {
+	hit := &fakeCounter{}
+	miss := &fakeCounter{}
+	issued := &fakeCounter{}
+	active := &fakeGauge{}
+	obs := &fakeObserver{}
+	store, err := New(WithMetrics(Metrics{Issued: issued, VerifyHit: hit, VerifyMiss: miss, Active: active}), WithObserver(obs))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n := store.Nonce("test")
+	if issued.count != 1 {
+		t.Errorf("Expected Issued counter to be 1, got %d", issued.count)
+	}
+	if active.value != 1 {
+		t.Errorf("Expected Active gauge to be 1, got %v", active.value)
+	}
+	if !store.Verify(n, "test") {
+		t.Errorf("Expected Verify on valid key to return true")
+	}
+	if hit.count != 1 {
+		t.Errorf("Expected VerifyHit counter to be 1, got %d", hit.count)
+	}
+	if store.Verify(n, "test") {
+		t.Errorf("Expected second Verify on once valid key to return false")
+	}
+	if miss.count != 1 {
+		t.Errorf("Expected VerifyMiss counter to be 1, got %d", miss.count)
+	}
+	if len(obs.issued) != 1 || obs.issued[0] != "test" {
+		t.Errorf("Expected OnIssue to have recorded one issuance, got %v", obs.issued)
+	}
+	if len(obs.results) != 2 || obs.results[0] != VerifyResultHit || obs.results[1] != VerifyResultMiss {
+		t.Errorf("Expected OnVerify to have recorded [hit miss], got %v", obs.results)
+	}
+}
+
+func TestSweep(t *testing.T) {
+	clock := newFakeClock()
+	store, err := New(WithClock(clock), WithSweepInterval(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Timeout(25 * time.Millisecond)
+	store.Nonce("test")
+	if removed := store.Sweep(); removed != 0 {
+		t.Errorf("Expected Sweep before expiry to remove nothing, got %d", removed)
+	}
+	clock.Advance(26 * time.Millisecond)
+	if removed := store.Sweep(); removed != 1 {
+		t.Errorf("Expected Sweep after expiry to remove one nonce, got %d", removed)
+	}
+	if removed := store.Sweep(); removed != 0 {
+		t.Errorf("Expected second Sweep to have nothing left to remove, got %d", removed)
+	}
+}
+
+func TestStatelessUsage(t *testing.T) {
+	store, err := NewStateless([]byte("super-secret-key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Timeout(time.Duration(25 * time.Millisecond))
+	if store.VerifyStateless("", "test") {
+		t.Errorf("Expected VerifyStateless on invalid nonce to return false")
+	}
+	n, err := store.NonceStateless("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !store.VerifyStateless(n, "test") {
+		t.Errorf("Expected VerifyStateless on valid nonce to return true")
+	}
+	if store.VerifyStateless(n, "test") {
+		t.Errorf("Expected second VerifyStateless on once valid nonce to return false")
+	}
+	n, err = store.NonceStateless("test2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Duration(26 * time.Millisecond))
+	if store.VerifyStateless(n, "test2") {
+		t.Errorf("Expected VerifyStateless on expired nonce to return false")
+	}
+	if _, err := NewStateless(nil); err == nil {
+		t.Errorf("Expected NewStateless with empty key to return an error")
+	}
+}
+
+// TestStatelessStoreRejectsStatefulCalls guards against a regression where
+// Nonce/Verify/Peek on a store created by NewStateless panicked on its nil
+// hash.Hash instead of behaving as documented no-ops; a stateless store
+// satisfies Store, so nothing stops a caller reaching for the wrong method
+// pair.
+func TestStatelessStoreRejectsStatefulCalls(t *testing.T) {
+	store, err := NewStateless([]byte("super-secret-key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := store.Nonce("test"); n != "" {
+		t.Errorf("Expected Nonce on a stateless store to return \"\", got %q", n)
+	}
+	if store.Verify("anything", "test") {
+		t.Errorf("Expected Verify on a stateless store to return false")
+	}
+	if store.Peek("anything", "test") {
+		t.Errorf("Expected Peek on a stateless store to return false")
+	}
+}
+
+// TestConcurrentAccessIsRaceFree guards against regressions where a method
+// reads or writes store state -- s.expiration, or the shared s.h via
+// computeHash -- without s.m held.  It doesn't assert on results, just gives
+// `go test -race` concurrent Peek/NonceStateless/Timeout calls to catch.
+func TestConcurrentAccessIsRaceFree(t *testing.T) {
+	store, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Timeout(time.Hour)
+	n := store.Nonce("test")
+
+	stateless, err := NewStateless([]byte("super-secret-key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stateless.Timeout(time.Hour)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			store.Peek(n, "test")
+		}()
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			stateless.NonceStateless("test")
+			stateless.Timeout(time.Duration(i+1) * time.Minute)
+		}(i)
+	}
+	wg.Wait()
+}
+
+// BenchmarkSustainedIssuance issues far more nonces than it ever verifies,
+// relying on Sweep to keep the store's memory bounded rather than letting
+// expired entries accumulate for the life of the benchmark.
+func BenchmarkSustainedIssuance(b *testing.B) {
+	clock := newFakeClock()
+	store, err := New(WithClock(clock), WithSweepInterval(time.Millisecond))
+	if err != nil {
+		b.Fatal(err)
+	}
+	store.Timeout(time.Millisecond)
+	for i := 0; i < b.N; i++ {
+		store.Nonce("test")
+		if i%100 == 0 {
+			clock.Advance(2 * time.Millisecond)
+			store.Sweep()
+		}
+	}
+	if active := len(store.nonces); active > 200 {
+		b.Errorf("Expected sweeping to bound active nonces, got %d outstanding", active)
+	}
+}
@@ -0,0 +1,141 @@
+package nonce
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"errors"
+	"hash"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// redisKeyPrefix namespaces the keys RedisStore writes so a nonce store can
+// safely share a Redis instance with other data.
+const redisKeyPrefix = "nonce:"
+
+// redisConsumeScript atomically deletes a key only if its value still
+// matches what Verify read, so two concurrent Verify calls for the same
+// one-time nonce can't both succeed.
+const redisConsumeScript = `
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+else
+	return 0
+end
+`
+
+// RedisClient is the subset of a Redis client's API that RedisStore needs.
+// Its methods take no context.Context and return plain values, so a client
+// such as *redis.Client from github.com/redis/go-redis/v9 needs a thin
+// wrapper to satisfy it; this package depends on no specific driver.
+type RedisClient interface {
+	Set(key, value string, ttl time.Duration) error
+	Get(key string) (string, error)
+	Eval(script string, keys []string, args ...interface{}) (interface{}, error)
+}
+
+// RedisStore is a Store backed by Redis.  Nonces are written with a TTL
+// matching their expiration so Redis itself reclaims them, which means
+// RedisStore has no equivalent of MemoryStore's mindExpiration sweep.
+// Because the backing store is shared, nonces issued by one instance can be
+// verified by any other instance pointed at the same Redis, provided every
+// instance is given the same Salt; NewRedisStore picks a random salt.
+type RedisStore struct {
+	m          sync.Mutex
+	client     RedisClient
+	salt       string
+	expiration time.Duration
+	h          hash.Hash
+}
+
+// NewRedisStore returns a nonce store backed by client.
+func NewRedisStore(client RedisClient) (*RedisStore, error) {
+	if client == nil {
+		return nil, errors.New("nonce: NewRedisStore requires a non-nil client")
+	}
+	var randBytes = make([]byte, 20)
+	if _, e := rand.Read(randBytes); e != nil {
+		return nil, e
+	}
+	return &RedisStore{
+		client:     client,
+		salt:       string(randBytes),
+		expiration: time.Duration(30 * time.Minute),
+		h:          sha1.New(),
+	}, nil
+}
+
+// Timeout allows you to specify how long nonces are valid for.
+func (s *RedisStore) Timeout(t time.Duration) Store {
+	s.m.Lock()
+	s.expiration = t
+	s.m.Unlock()
+	return s
+}
+
+// Salt allows you to specify the salt used internally while creating nonces.
+func (s *RedisStore) Salt(salt string) Store {
+	s.m.Lock()
+	s.salt = salt
+	s.m.Unlock()
+	return s
+}
+
+// Nonce creates a nonce for the provided action and writes it to Redis with
+// a TTL equal to the store's expiration.
+func (s *RedisStore) Nonce(action string) string {
+	s.m.Lock()
+	expiration := s.expiration
+	t := time.Now().Add(expiration)
+	h := computeHash(s.h, action, s.salt, t)
+	s.m.Unlock()
+	s.client.Set(redisKeyPrefix+h, strconv.FormatInt(t.UnixNano(), 10), expiration)
+	return h
+}
+
+// Verify validates a nonce against an action and atomically deletes it from
+// Redis so it cannot be verified a second time.
+func (s *RedisStore) Verify(nonce, action string) bool {
+	t, ok := s.lookup(nonce, action)
+	if !ok {
+		return false
+	}
+	result, err := s.client.Eval(redisConsumeScript, []string{redisKeyPrefix + nonce}, strconv.FormatInt(t.UnixNano(), 10))
+	if err != nil {
+		return false
+	}
+	consumed, _ := result.(int64)
+	return consumed == 1
+}
+
+// Peek allows you to see if a valid matching nonce exists without actually
+// removing it from Redis.
+func (s *RedisStore) Peek(nonce, action string) bool {
+	_, ok := s.lookup(nonce, action)
+	return ok
+}
+
+// lookup fetches nonce from Redis and confirms it hasn't expired and was
+// issued for action.
+func (s *RedisStore) lookup(nonce, action string) (time.Time, bool) {
+	raw, err := s.client.Get(redisKeyPrefix + nonce)
+	if err != nil {
+		return time.Time{}, false
+	}
+	nanos, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	t := time.Unix(0, nanos)
+	if time.Now().After(t) {
+		return time.Time{}, false
+	}
+	s.m.Lock()
+	h := computeHash(s.h, action, s.salt, t)
+	s.m.Unlock()
+	if h != nonce {
+		return time.Time{}, false
+	}
+	return t, true
+}
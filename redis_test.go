@@ -0,0 +1,74 @@
+package nonce
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// fakeRedisClient is a minimal in-memory stand-in for a real Redis client,
+// just enough to exercise RedisStore without a network dependency.
+type fakeRedisClient struct {
+	data map[string]string
+}
+
+func newFakeRedisClient() *fakeRedisClient {
+	return &fakeRedisClient{data: map[string]string{}}
+}
+
+func (c *fakeRedisClient) Set(key, value string, ttl time.Duration) error {
+	c.data[key] = value
+	return nil
+}
+
+func (c *fakeRedisClient) Get(key string) (string, error) {
+	v, ok := c.data[key]
+	if !ok {
+		return "", errors.New("redis: nil")
+	}
+	return v, nil
+}
+
+func (c *fakeRedisClient) Eval(script string, keys []string, args ...interface{}) (interface{}, error) {
+	if len(keys) != 1 || len(args) != 1 {
+		return nil, errors.New("unexpected call")
+	}
+	if c.data[keys[0]] != args[0] {
+		return int64(0), nil
+	}
+	delete(c.data, keys[0])
+	return int64(1), nil
+}
+
+var _ Store = (*MemoryStore)(nil)
+var _ Store = (*RedisStore)(nil)
+var _ Store = (*SQLStore)(nil)
+
+func TestRedisStoreUsage(t *testing.T) {
+	store, err := NewRedisStore(newFakeRedisClient())
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Timeout(time.Duration(25 * time.Millisecond))
+	if store.Verify("", "test") {
+		t.Errorf("Expected Verify on invalid key to return false")
+	}
+	n := store.Nonce("test")
+	if !store.Peek(n, "test") {
+		t.Errorf("Expected Peek on valid key to return true")
+	}
+	if !store.Verify(n, "test") {
+		t.Errorf("Expected Verify on valid key to return true")
+	}
+	if store.Verify(n, "test") {
+		t.Errorf("Expected second Verify on once valid key to return false")
+	}
+	n = store.Nonce("test2")
+	time.Sleep(time.Duration(26 * time.Millisecond))
+	if store.Verify(n, "test2") {
+		t.Errorf("Expected Verify on expired key to return false")
+	}
+	if _, err := NewRedisStore(nil); err == nil {
+		t.Errorf("Expected NewRedisStore with nil client to return an error")
+	}
+}
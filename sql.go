@@ -0,0 +1,148 @@
+package nonce
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"database/sql"
+	"errors"
+	"fmt"
+	"hash"
+	"sync"
+	"time"
+)
+
+// SQLStoreSchema is the table SQLStore expects to exist.  Verify reads a
+// row by its hash primary key, checks it hasn't expired and that the hash
+// matches the action, then deletes it by that same primary key and checks
+// the affected row count -- no engine-specific feature like RETURNING is
+// required.  The queries in this file do use Postgres-style "$1" positional
+// placeholders, though, so callers on a driver that expects "?" (e.g.
+// MySQL, SQLite3) will need to adapt them.
+const SQLStoreSchema = `
+CREATE TABLE nonces (
+	hash TEXT PRIMARY KEY,
+	expires_at TIMESTAMP NOT NULL
+)
+`
+
+// SQLStore is a Store backed by a SQL database, so nonces survive a process
+// restart and can be verified by any instance sharing the database, provided
+// every instance is given the same Salt; NewSQLStore picks a random salt.  A
+// background goroutine deletes expired rows every five times the store's
+// expiration, as read at the start of each wait.
+type SQLStore struct {
+	m          sync.Mutex
+	db         *sql.DB
+	table      string
+	salt       string
+	expiration time.Duration
+	h          hash.Hash
+}
+
+// NewSQLStore returns a nonce store backed by db.  db must already have the
+// table described by SQLStoreSchema.
+func NewSQLStore(db *sql.DB) (*SQLStore, error) {
+	if db == nil {
+		return nil, errors.New("nonce: NewSQLStore requires a non-nil *sql.DB")
+	}
+	var randBytes = make([]byte, 20)
+	if _, e := rand.Read(randBytes); e != nil {
+		return nil, e
+	}
+	var rval = &SQLStore{
+		db:         db,
+		table:      "nonces",
+		salt:       string(randBytes),
+		expiration: time.Duration(30 * time.Minute),
+		h:          sha1.New(),
+	}
+	go rval.sweep()
+	return rval, nil
+}
+
+// Timeout allows you to specify how long nonces are valid for.
+func (s *SQLStore) Timeout(t time.Duration) Store {
+	s.m.Lock()
+	s.expiration = t
+	s.m.Unlock()
+	return s
+}
+
+// Salt allows you to specify the salt used internally while creating nonces.
+func (s *SQLStore) Salt(salt string) Store {
+	s.m.Lock()
+	s.salt = salt
+	s.m.Unlock()
+	return s
+}
+
+// Nonce creates a nonce for the provided action and inserts it into the
+// table with its expiry.
+func (s *SQLStore) Nonce(action string) string {
+	s.m.Lock()
+	expiration := s.expiration
+	t := time.Now().Add(expiration)
+	h := computeHash(s.h, action, s.salt, t)
+	s.m.Unlock()
+	s.db.Exec(fmt.Sprintf(`INSERT INTO %s (hash, expires_at) VALUES ($1, $2)`, s.table), h, t)
+	return h
+}
+
+// Verify validates a nonce against an action.  It looks the row up and
+// confirms it hasn't expired and that the hash matches action before
+// deleting anything -- mirroring RedisStore.Verify's lookup-then-consume
+// order -- so a Verify call with the wrong action is a no-op rather than
+// burning a still-valid nonce.  The row is then deleted by its
+// (already-matched) hash, so a concurrent Verify for the same nonce can
+// delete it at most once.
+func (s *SQLStore) Verify(nonce, action string) bool {
+	var expiresAt time.Time
+	row := s.db.QueryRow(fmt.Sprintf(`SELECT expires_at FROM %s WHERE hash = $1`, s.table), nonce)
+	if err := row.Scan(&expiresAt); err != nil {
+		return false
+	}
+	if time.Now().After(expiresAt) {
+		return false
+	}
+	s.m.Lock()
+	h := computeHash(s.h, action, s.salt, expiresAt)
+	s.m.Unlock()
+	if h != nonce {
+		return false
+	}
+	res, err := s.db.Exec(fmt.Sprintf(`DELETE FROM %s WHERE hash = $1`, s.table), nonce)
+	if err != nil {
+		return false
+	}
+	affected, err := res.RowsAffected()
+	return err == nil && affected == 1
+}
+
+// Peek allows you to see if a valid matching nonce exists without actually
+// removing it from the table.
+func (s *SQLStore) Peek(nonce, action string) bool {
+	var expiresAt time.Time
+	row := s.db.QueryRow(fmt.Sprintf(`SELECT expires_at FROM %s WHERE hash = $1`, s.table), nonce)
+	if err := row.Scan(&expiresAt); err != nil {
+		return false
+	}
+	if time.Now().After(expiresAt) {
+		return false
+	}
+	s.m.Lock()
+	h := computeHash(s.h, action, s.salt, expiresAt)
+	s.m.Unlock()
+	return h == nonce
+}
+
+// sweep periodically deletes expired rows, analogous to MemoryStore's
+// mindExpiration.
+func (s *SQLStore) sweep() {
+	for {
+		s.m.Lock()
+		expiration := s.expiration
+		s.m.Unlock()
+		time.Sleep(5 * expiration)
+		s.db.Exec(fmt.Sprintf(`DELETE FROM %s WHERE expires_at < $1`, s.table), time.Now())
+	}
+}
@@ -0,0 +1,160 @@
+package nonce
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeSQLDriver is a minimal in-memory stand-in for a real SQL driver, just
+// enough to exercise SQLStore's INSERT/SELECT/DELETE queries without a real
+// database.
+type fakeSQLDriver struct {
+	mu   sync.Mutex
+	rows map[string]time.Time
+}
+
+func (d *fakeSQLDriver) Open(name string) (driver.Conn, error) {
+	return &fakeSQLConn{d: d}, nil
+}
+
+type fakeSQLConn struct {
+	d *fakeSQLDriver
+}
+
+func (c *fakeSQLConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, errors.New("fakeSQLConn: Prepare not supported, only Exec/Query")
+}
+
+func (c *fakeSQLConn) Close() error { return nil }
+
+func (c *fakeSQLConn) Begin() (driver.Tx, error) {
+	return nil, errors.New("fakeSQLConn: transactions not supported")
+}
+
+func (c *fakeSQLConn) Exec(query string, args []driver.Value) (driver.Result, error) {
+	c.d.mu.Lock()
+	defer c.d.mu.Unlock()
+	switch {
+	case strings.HasPrefix(query, "INSERT INTO"):
+		c.d.rows[args[0].(string)] = args[1].(time.Time)
+		return driver.RowsAffected(1), nil
+	case strings.HasPrefix(query, "DELETE FROM") && strings.Contains(query, "hash ="):
+		hash := args[0].(string)
+		if _, ok := c.d.rows[hash]; !ok {
+			return driver.RowsAffected(0), nil
+		}
+		delete(c.d.rows, hash)
+		return driver.RowsAffected(1), nil
+	case strings.HasPrefix(query, "DELETE FROM"):
+		cutoff := args[0].(time.Time)
+		var removed int64
+		for k, exp := range c.d.rows {
+			if exp.Before(cutoff) {
+				delete(c.d.rows, k)
+				removed++
+			}
+		}
+		return driver.RowsAffected(removed), nil
+	}
+	return nil, errors.New("fakeSQLConn: unexpected exec " + query)
+}
+
+func (c *fakeSQLConn) Query(query string, args []driver.Value) (driver.Rows, error) {
+	c.d.mu.Lock()
+	defer c.d.mu.Unlock()
+	if !strings.HasPrefix(query, "SELECT expires_at") {
+		return nil, errors.New("fakeSQLConn: unexpected query " + query)
+	}
+	exp, ok := c.d.rows[args[0].(string)]
+	if !ok {
+		return &fakeSQLRows{done: true}, nil
+	}
+	return &fakeSQLRows{expiresAt: exp}, nil
+}
+
+// fakeSQLRows yields at most the single expires_at row SQLStore's Verify and
+// Peek queries expect back.
+type fakeSQLRows struct {
+	expiresAt time.Time
+	done      bool
+}
+
+func (r *fakeSQLRows) Columns() []string { return []string{"expires_at"} }
+func (r *fakeSQLRows) Close() error      { return nil }
+func (r *fakeSQLRows) Next(dest []driver.Value) error {
+	if r.done {
+		return io.EOF
+	}
+	r.done = true
+	dest[0] = r.expiresAt
+	return nil
+}
+
+// fakeSQLDriverSeq keeps each test's driver registration name unique, since
+// sql.Register panics if the same name is registered twice.
+var fakeSQLDriverSeq int64
+
+func newFakeSQLDB(t *testing.T) *sql.DB {
+	t.Helper()
+	name := t.Name() + "-" + strconv.FormatInt(atomic.AddInt64(&fakeSQLDriverSeq, 1), 10)
+	sql.Register(name, &fakeSQLDriver{rows: map[string]time.Time{}})
+	db, err := sql.Open(name, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestSQLStoreUsage(t *testing.T) {
+	store, err := NewSQLStore(newFakeSQLDB(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Timeout(time.Duration(25 * time.Millisecond))
+	if store.Verify("", "test") {
+		t.Errorf("Expected Verify on invalid key to return false")
+	}
+	n := store.Nonce("test")
+	if !store.Peek(n, "test") {
+		t.Errorf("Expected Peek on valid key to return true")
+	}
+	if !store.Verify(n, "test") {
+		t.Errorf("Expected Verify on valid key to return true")
+	}
+	if store.Verify(n, "test") {
+		t.Errorf("Expected second Verify on once valid key to return false")
+	}
+	n = store.Nonce("test2")
+	time.Sleep(time.Duration(26 * time.Millisecond))
+	if store.Verify(n, "test2") {
+		t.Errorf("Expected Verify on expired key to return false")
+	}
+	if _, err := NewSQLStore(nil); err == nil {
+		t.Errorf("Expected NewSQLStore with nil db to return an error")
+	}
+}
+
+// TestSQLStoreVerifyWrongActionDoesNotConsume guards against Verify deleting
+// a still-valid row before it has confirmed the row was issued for action --
+// a caller passing the wrong action must get a no-op, not a burned nonce.
+func TestSQLStoreVerifyWrongActionDoesNotConsume(t *testing.T) {
+	store, err := NewSQLStore(newFakeSQLDB(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := store.Nonce("test")
+	if store.Verify(n, "wrong-action") {
+		t.Errorf("Expected Verify with the wrong action to return false")
+	}
+	if !store.Verify(n, "test") {
+		t.Errorf("Expected Verify with the right action to still succeed after a mismatched attempt")
+	}
+}